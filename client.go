@@ -1,12 +1,12 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"go_chat_2/config"
-	"go_chat_2/models"
+	"bytes"
+	"flag"
 	"log"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -25,11 +25,9 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 10000
-)
 
-var (
-	newline = []byte{'*'}
-	space   = []byte{' '}
+	// Size of a client's inbound message queue before the overflow policy kicks in.
+	messageQueueSize = 256
 )
 
 var upgrader = websocket.Upgrader{
@@ -37,6 +35,31 @@ var upgrader = websocket.Upgrader{
 	WriteBufferSize: 4096,
 }
 
+// overflowPolicyFlag selects what happens when a client's messageChan is full,
+// i.e. readPump is producing faster than processMessages can keep up.
+var overflowPolicyFlag = flag.String("message-overflow-policy", "drop-oldest", "backpressure policy for a full client queue: drop-oldest or disconnect")
+
+// overflowPolicy decides what readPump does when messageChan is full.
+type overflowPolicy int
+
+const (
+	dropOldest overflowPolicy = iota
+	disconnectOnOverflow
+)
+
+func overflowPolicyFromFlag() overflowPolicy {
+	if *overflowPolicyFlag == "disconnect" {
+		return disconnectOnOverflow
+	}
+	return dropOldest
+}
+
+// bufferPool recycles the buffers used to carry raw frames from readPump to
+// processMessages, so a busy client doesn't churn the allocator.
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
 // Client represents the websocket client at the server
 type Client struct {
 	// The actual websocket connection
@@ -46,145 +69,69 @@ type Client struct {
 	rooms    map[*Room]bool
 	Name     string    `json:"name"`
 	ID       uuid.UUID `json:"id"`
-}
-
-func newClient(conn *websocket.Conn, wsServer *WsServer, name string) *Client {
-	return &Client{
-		ID:       uuid.New(),
-		Name:     name,
-		conn:     conn,
-		wsServer: wsServer,
-		send:     make(chan []byte, 256),
-		rooms:    make(map[*Room]bool),
-	}
-}
-
-func (client *Client) handleNewMessage(jsonMessage []byte) {
-	var message Message
-	if err := json.Unmarshal(jsonMessage, &message); err != nil {
-		log.Printf("Error on unmarshal JSON message %s", err)
-	}
-	fmt.Printf("Message Receving: %v \n", message)
-	// Attach the client object as the sender of the message
-	message.Sender = client
-
-	switch message.Action {
-	case SendMessageAction:
-		// The send-message action, this will send message to a specific room now.
-		// Which room will depend on the message Target
-		roomId := message.Target.GetId()
-		// Use the ChatServer method to find the room, and if found, broadcast!
-		if room := client.wsServer.findRoomById(roomId); room != nil {
-			room.broadcast <- &message
-		}
-	// We delegate the join and leave actions.
-	case JoinRoomAction:
-		client.handleJoinRoomMessage(message)
-	case LeaveRoomAction:
-		client.handleLeaveRoomMessage(message)
-	case JoinRoomPrivateAction:
-		client.handleJoinRoomPrivateMessage(message)
-	}
-}
-
-func (client *Client) handleJoinRoomMessage(message Message) {
-	roomName := message.Message
-
-	client.joinRoom(roomName, nil)
-}
-
-func (client *Client) handleLeaveRoomMessage(message Message) {
-	room := client.wsServer.findRoomById(message.Message)
-	if room == nil {
-		return
-	}
-	if _, ok := client.rooms[room]; ok {
-		delete(client.rooms, room)
-	}
-
-	room.unregister <- client
-}
-
-func (client *Client) handleJoinRoomPrivateMessage(message Message) {
-
-	target := client.wsServer.findUserByID(message.Message)
-
-	if target == nil {
-		return
-	}
-
-	// create unique room name combined to the two IDs
-	fmt.Println(message.Message)
-	roomName := message.Message + client.ID.String()
-
-	// Join room
-	joinedRoom := client.joinRoom(roomName, target)
 
-	// Instead of instantaneously joining the target client.
-	// Let the target client join with a invite request over pub/sub
-	if joinedRoom != nil {
-		client.inviteTargetUser(target, joinedRoom)
-	}
+	// messageChan decouples reading frames off the socket from decoding and
+	// dispatching them, so a slow room broadcast can't stall pong handling.
+	messageChan chan *bytes.Buffer
+	closeChan   chan struct{}
+	closeOnce   sync.Once
+	wg          sync.WaitGroup
+	overflow    overflowPolicy
+
+	// readDone is closed by readPump right before it calls disconnect, so
+	// disconnect can wait for readPump - messageChan's only producer - to be
+	// done before closing messageChan out from under it.
+	readDone chan struct{}
+
+	// disconnectOnce guards disconnect itself: readPump's own deferred call,
+	// the disconnect-on-overflow policy, and closeWithProtocolError can all
+	// reach it independently, and running teardown twice double-closes send.
+	disconnectOnce sync.Once
+
+	// sendMu guards send and sendClosed together, so Send can never race
+	// disconnect's close(send) - e.g. a room's async history replay (see
+	// Room.replayHistoryTo) calling Send after the client has already torn
+	// down would otherwise panic on a send to a closed channel.
+	sendMu     sync.Mutex
+	sendClosed bool
+
+	// since is the optional ?since= cursor from ServerWs, limiting history
+	// replay on room join to messages newer than it.
+	since *time.Time
 }
 
-// JoinRoom now returns a room or nil
-func (client *Client) joinRoom(roomName string, sender models.User) *Room {
-
-	room := client.wsServer.findRoomByName(roomName)
-	if room == nil {
-		room = client.wsServer.createRoom(roomName, sender != nil)
-	}
-
-	// Don't allow to join private rooms through public room message
-	if sender == nil && room.Private {
-		return nil
-	}
-
-	if !client.isInRoom(room) {
-		client.rooms[room] = true
-		room.register <- client
-		client.notifyRoomJoined(room, sender)
-	}
-	return room
-}
-
-// Send out invite message over pub/sub in the general channel.
-func (client *Client) inviteTargetUser(target models.User, room *Room) {
-	inviteMessage := &Message{
-		Action:  JoinRoomPrivateAction,
-		Message: target.GetId(),
-		Target:  room,
-		Sender:  client,
-	}
-
-	if err := config.Redis.Publish(ctx, PubSubGeneralChannel, inviteMessage.encode()).Err(); err != nil {
-		log.Println(err)
+func newClient(conn *websocket.Conn, wsServer *WsServer, name string, id uuid.UUID, since *time.Time) *Client {
+	return &Client{
+		ID:          id,
+		Name:        name,
+		conn:        conn,
+		wsServer:    wsServer,
+		send:        make(chan []byte, 256),
+		rooms:       make(map[*Room]bool),
+		messageChan: make(chan *bytes.Buffer, messageQueueSize),
+		closeChan:   make(chan struct{}),
+		readDone:    make(chan struct{}),
+		overflow:    overflowPolicyFromFlag(),
+		since:       since,
 	}
 }
 
-// New Method
-// Check if the client is not yet in the room
-func (client *Client) isInRoom(room *Room) bool {
-	if _, ok := client.rooms[room]; ok {
-		return true
-	}
-	return false
+// HistorySince implements historySince for Room.replayHistoryTo.
+func (client *Client) HistorySince() *time.Time {
+	return client.since
 }
 
-// New Method
-// Notify the client of the new room he/she joined
-func (client *Client) notifyRoomJoined(room *Room, sender models.User) {
-	message := &Message{
-		Action: RoomJoinedAction,
-		Target: room,
-		Sender: sender,
+func (client *Client) handleNewMessage(jsonMessage []byte) {
+	if err := dispatchMessage(client.wsServer, client, jsonMessage); err != nil {
+		if protoErr, ok := err.(*protocolError); ok {
+			client.closeWithProtocolError(protoErr)
+		}
 	}
-
-	client.send <- message.encode()
 }
 
 func (client *Client) readPump() {
 	defer func() {
+		close(client.readDone)
 		client.disconnect()
 	}()
 
@@ -195,7 +142,9 @@ func (client *Client) readPump() {
 		return nil
 	})
 
-	// Start endless read loop, waiting for message from client
+	// Start endless read loop, waiting for message from client. Frames are
+	// handed off to messageChan so a slow processMessages/room broadcast
+	// can't delay pong handling and get the connection dropped as dead.
 	for {
 		_, jsonMessage, err := client.conn.ReadMessage()
 		if err != nil {
@@ -204,10 +153,73 @@ func (client *Client) readPump() {
 			}
 			break
 		}
-		// client.wsServer.broadcast <- jsonMessage
-		client.handleNewMessage(jsonMessage)
+		buf := bufferPool.Get().(*bytes.Buffer)
+		buf.Reset()
+		buf.Write(jsonMessage)
+		client.enqueueMessage(buf)
+	}
+
+}
+
+// enqueueMessage hands a frame to processMessages, applying the configured
+// overflow policy when the client can't keep up.
+func (client *Client) enqueueMessage(buf *bytes.Buffer) {
+	select {
+	case client.messageChan <- buf:
+		recordQueueDepth(len(client.messageChan))
+		return
+	default:
 	}
 
+	switch client.overflow {
+	case disconnectOnOverflow:
+		recordQueueDrop()
+		bufferPool.Put(buf)
+		go client.disconnect()
+	default: // dropOldest
+		select {
+		case old := <-client.messageChan:
+			bufferPool.Put(old)
+			recordQueueDrop()
+		default:
+		}
+		select {
+		case client.messageChan <- buf:
+		default:
+			bufferPool.Put(buf)
+		}
+	}
+}
+
+// processMessages decodes and dispatches frames pushed by readPump. It runs
+// on its own goroutine so a slow room broadcast or Redis publish never blocks
+// the read loop.
+func (client *Client) processMessages() {
+	defer client.wg.Done()
+	for {
+		select {
+		case buf, ok := <-client.messageChan:
+			if !ok {
+				return
+			}
+			client.handleNewMessage(buf.Bytes())
+			buf.Reset()
+			bufferPool.Put(buf)
+		case <-client.closeChan:
+			return
+		}
+	}
+}
+
+// Close signals processMessages to stop, waits for it to return, and retires
+// messageChan. Frames still queued are not processed. It's safe to call more
+// than once.
+func (client *Client) Close() {
+	client.closeOnce.Do(func() {
+		close(client.closeChan)
+		client.wg.Wait()
+		close(client.messageChan)
+	})
 }
 
 func (client *Client) writePump() {
@@ -225,20 +237,10 @@ func (client *Client) writePump() {
 				return
 			}
 
-			w, err := client.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Attach queued chat messages to the current websocket message.
-			n := len(client.send)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-client.send)
-			}
-
-			if err := w.Close(); err != nil {
+			// One frame per Message: coalescing queued messages onto a
+			// single frame with a '*' separator used to corrupt JSON
+			// parsing on the client, and left per-message acks ambiguous.
+			if err := client.conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -250,13 +252,70 @@ func (client *Client) writePump() {
 	}
 }
 
+// disconnect tears the client down: it stops the read loop, stops
+// processMessages, leaves every room and unregisters client from the server.
+// readPump's own deferred call, the disconnect-on-overflow policy, and
+// closeWithProtocolError can all reach this independently while the other is
+// still running, so disconnectOnce makes teardown - and the channel closes
+// it does - happen exactly once.
 func (client *Client) disconnect() {
-	client.wsServer.unregister <- client
-	for room := range client.rooms {
-		room.unregister <- client
+	client.disconnectOnce.Do(func() {
+		// Unblocks a readPump stuck in conn.ReadMessage() so it actually
+		// reaches its close(readDone); without this a disconnect triggered
+		// by the overflow policy or a protocol error could wait forever.
+		client.conn.Close()
+		<-client.readDone
+
+		client.Close()
+		client.wsServer.unregister <- client
+		for room := range client.rooms {
+			room.Unregister(client)
+		}
+
+		client.sendMu.Lock()
+		client.sendClosed = true
+		close(client.send)
+		client.sendMu.Unlock()
+	})
+}
+
+// Send queues message on the client's outbound channel without blocking, so
+// a slow reader can't stall the room that's broadcasting to it. It reports
+// false once the client has disconnected, instead of sending on (and
+// panicking on) a closed channel.
+func (client *Client) Send(message []byte) bool {
+	client.sendMu.Lock()
+	defer client.sendMu.Unlock()
+	if client.sendClosed {
+		return false
+	}
+
+	select {
+	case client.send <- message:
+		return true
+	default:
+		return false
 	}
-	close(client.send)
-	client.conn.Close()
+}
+
+// Rooms returns the set of rooms the client currently belongs to.
+func (client *Client) Rooms() map[*Room]bool {
+	return client.rooms
+}
+
+// AddRoom records that the client has joined room.
+func (client *Client) AddRoom(room *Room) {
+	client.rooms[room] = true
+}
+
+// RemoveRoom records that the client has left room.
+func (client *Client) RemoveRoom(room *Room) {
+	delete(client.rooms, room)
+}
+
+// Disconnect tears the client down the same way a closed socket would.
+func (client *Client) Disconnect() {
+	client.disconnect()
 }
 
 // ServerWs handles websocket request from clients requests.
@@ -275,8 +334,32 @@ func ServerWs(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	client := newClient(conn, wsServer, name[0])
+	var since *time.Time
+	if raw := r.URL.Query().Get("since"); raw != "" {
+		if nanos, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			t := time.Unix(0, nanos)
+			since = &t
+		} else {
+			log.Printf("invalid 'since' query param %q: %v", raw, err)
+		}
+	}
+
+	// A client reconnecting after a brief disconnect can pass back its
+	// previous id so ack-based replay (see Room.replayHistoryTo) picks up
+	// where it left off instead of starting a fresh identity.
+	clientID := uuid.New()
+	if raw := r.URL.Query().Get("id"); raw != "" {
+		if parsed, err := uuid.Parse(raw); err == nil {
+			clientID = parsed
+		} else {
+			log.Printf("invalid 'id' query param %q: %v", raw, err)
+		}
+	}
+
+	client := newClient(conn, wsServer, name[0], clientID, since)
 
+	client.wg.Add(1)
+	go client.processMessages()
 	go client.writePump()
 	go client.readPump()
 
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go_chat_2/models"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dispatchMessage decodes a raw frame and routes it to the right handler,
+// regardless of which transport (websocket, long-poll, ...) produced it. A
+// returned *protocolError means jsonMessage itself couldn't be trusted and
+// the caller should close the connection; a *userError has already been
+// reported to sender via sendError and the connection should stay open.
+func dispatchMessage(wsServer *WsServer, sender HandlerClient, jsonMessage []byte) error {
+	var message Message
+	if err := json.Unmarshal(jsonMessage, &message); err != nil {
+		return &protocolError{closeCode: websocket.CloseInvalidFramePayloadData, reason: "malformed message"}
+	}
+	// Attach the client object as the sender of the message
+	message.Sender = sender
+
+	if !knownActions[message.Action] {
+		err := &userError{code: ErrUnknownAction, text: fmt.Sprintf("unknown action %q", message.Action)}
+		sendError(sender, err)
+		return err
+	}
+	if len(message.Message) > maxMessageTextLength {
+		err := &userError{code: ErrPayloadTooLarge, text: "message exceeds maximum length"}
+		sendError(sender, err)
+		return err
+	}
+
+	switch message.Action {
+	case SendMessageAction:
+		// The send-message action, this will send message to a specific room now.
+		// Which room will depend on the message Target
+		if message.Target == nil {
+			err := &userError{code: ErrRoomNotFound, text: "no target room"}
+			sendError(sender, err)
+			return err
+		}
+		// Use the ChatServer method to find the room, and if found, broadcast!
+		if room := wsServer.findRoomById(message.Target.GetId()); room != nil {
+			room.Broadcast(&message)
+		} else {
+			err := &userError{code: ErrRoomNotFound, text: "room not found"}
+			sendError(sender, err)
+			return err
+		}
+	// We delegate the join and leave actions.
+	case JoinRoomAction:
+		joinRoom(wsServer, sender, message.Message, nil)
+	case LeaveRoomAction:
+		leaveRoom(wsServer, sender, message.Message)
+	case JoinRoomPrivateAction:
+		if err := joinRoomPrivate(wsServer, sender, message.Message); err != nil {
+			sendError(sender, err)
+			return err
+		}
+	case FetchHistoryAction:
+		fetchHistory(wsServer, sender, message)
+	case AckAction:
+		handleAck(wsServer, sender, message)
+	}
+	return nil
+}
+
+// handleAck records the highest Seq sender has processed for message.Target,
+// so a later reconnect replays only what was missed.
+func handleAck(wsServer *WsServer, sender HandlerClient, message Message) {
+	if message.Target == nil {
+		return
+	}
+	room := wsServer.findRoomById(message.Target.GetId())
+	if room == nil || room.messages == nil {
+		return
+	}
+	if err := room.messages.SaveAck(room.GetId(), sender.GetId(), message.Seq); err != nil {
+		log.Println(err)
+	}
+}
+
+// fetchHistory answers a FetchHistoryAction: message.Message is the room id
+// and message.Before (if set) pages backwards from that cursor.
+func fetchHistory(wsServer *WsServer, sender HandlerClient, message Message) {
+	room := wsServer.findRoomById(message.Message)
+	if room == nil || room.messages == nil {
+		return
+	}
+
+	var before *time.Time
+	if message.Before > 0 {
+		t := time.Unix(0, message.Before)
+		before = &t
+	}
+
+	history, err := room.messages.FetchHistory(room.GetId(), *historyPageSize, before)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	payloads := make([]string, len(history))
+	for i, entry := range history {
+		payloads[len(history)-1-i] = entry.Payload
+	}
+	room.sendHistory(sender, payloads)
+}
+
+func leaveRoom(wsServer *WsServer, sender HandlerClient, roomId string) {
+	room := wsServer.findRoomById(roomId)
+	if room == nil {
+		return
+	}
+	sender.RemoveRoom(room)
+
+	room.Unregister(sender)
+}
+
+func joinRoomPrivate(wsServer *WsServer, sender HandlerClient, targetId string) *userError {
+	target := wsServer.findUserByID(targetId)
+
+	if target == nil {
+		return &userError{code: ErrTargetNotFound, text: "target user not found"}
+	}
+
+	// create unique room name combined to the two IDs
+	roomName := targetId + sender.GetId()
+
+	// Join room
+	joinedRoom := joinRoom(wsServer, sender, roomName, target)
+
+	// Instead of instantaneously joining the target client.
+	// Let the target client join with a invite request over pub/sub
+	if joinedRoom != nil {
+		inviteTargetUser(wsServer, sender, target, joinedRoom)
+	}
+	return nil
+}
+
+// resolveRoom finds roomName, or creates it as private if it doesn't exist
+// yet. Calling this again to re-resolve roomName (rather than creating
+// unconditionally) lets a concurrent first joiner's room win instead of
+// each caller spawning its own sibling.
+func resolveRoom(wsServer *WsServer, roomName string, private bool) *Room {
+	room := wsServer.findRoomByName(roomName)
+	if room == nil {
+		room = wsServer.createRoom(roomName, private)
+	}
+	return room
+}
+
+// joinRoom finds or creates roomName and registers sender in it. privateWith
+// is the other party of a private (1:1) room, or nil for a public join.
+func joinRoom(wsServer *WsServer, sender HandlerClient, roomName string, privateWith models.User) *Room {
+
+	room := resolveRoom(wsServer, roomName, privateWith != nil)
+
+	// Don't allow to join private rooms through public room message
+	if privateWith == nil && room.Private {
+		return nil
+	}
+
+	if !isInRoom(sender, room) {
+		// room may have been reaped between resolveRoom and the Register
+		// call below; re-resolve once rather than unconditionally creating
+		// a second room, so a concurrent joiner's fresh room (if any) is
+		// reused instead of sender ending up in a sibling nobody else is in.
+		if !room.Register(sender) {
+			room = resolveRoom(wsServer, roomName, privateWith != nil)
+			if !room.Register(sender) {
+				return nil
+			}
+		}
+		sender.AddRoom(room)
+		notifyRoomJoined(sender, room, privateWith)
+	}
+	return room
+}
+
+// Send out invite message over pub/sub in the general channel.
+func inviteTargetUser(wsServer *WsServer, sender HandlerClient, target models.User, room *Room) {
+	inviteMessage := &Message{
+		Action:  JoinRoomPrivateAction,
+		Message: target.GetId(),
+		Target:  room,
+		Sender:  sender,
+	}
+
+	if err := wsServer.PubSub.Publish(ctx, PubSubGeneralChannel, inviteMessage.encode()); err != nil {
+		log.Println(err)
+	}
+}
+
+// isInRoom reports whether sender has already joined room.
+func isInRoom(sender HandlerClient, room *Room) bool {
+	_, ok := sender.Rooms()[room]
+	return ok
+}
+
+// notifyRoomJoined tells sender which room it just joined.
+func notifyRoomJoined(sender HandlerClient, room *Room, roomSender models.User) {
+	message := &Message{
+		Action: RoomJoinedAction,
+		Target: room,
+		Sender: roomSender,
+	}
+
+	sender.Send(message.encode())
+}
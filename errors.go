@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// protocolError means the frame itself couldn't be understood (malformed
+// JSON). The connection is no longer trustworthy and should
+// be closed rather than continuing to read from it.
+type protocolError struct {
+	closeCode int
+	reason    string
+}
+
+func (e *protocolError) Error() string { return e.reason }
+
+// userError is a problem with one specific request (unknown action, missing
+// room, ...). It's reported back to the sender as an Action: ErrorAction
+// Message; the connection stays open.
+type userError struct {
+	code string
+	text string
+}
+
+func (e *userError) Error() string { return e.text }
+
+// sendError reports a userError to sender as an Action: ErrorAction Message
+// carrying a machine-readable code, mirroring how notifyRoomJoined reports a
+// successful join.
+func sendError(sender HandlerClient, err *userError) {
+	message := &Message{
+		Action:    ErrorAction,
+		Message:   err.text,
+		ErrorCode: err.code,
+	}
+	sender.Send(message.encode())
+}
+
+// closeWithProtocolError closes client's connection with a close frame
+// describing why, instead of silently dropping it. disconnect runs on its
+// own goroutine since this is called from processMessages, which disconnect
+// would otherwise deadlock waiting on (it joins via client.wg). The close
+// frame also makes readPump's next ReadMessage fail, so its own deferred
+// disconnect call races this one; client.disconnectOnce makes that safe.
+func (client *Client) closeWithProtocolError(err *protocolError) {
+	closeMessage := websocket.FormatCloseMessage(err.closeCode, err.reason)
+	client.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(writeWait))
+	go client.disconnect()
+}
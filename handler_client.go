@@ -0,0 +1,20 @@
+package main
+
+// HandlerClient is what Room (and WsServer) need from a chat participant,
+// whether it's backed by a websocket connection or something else entirely.
+// *Client is the websocket-backed implementation; VirtualClient lets
+// server-side integrations (bots, bridges, moderators) join rooms and be
+// addressed as a Message sender without opening a socket.
+type HandlerClient interface {
+	GetId() string
+	GetName() string
+
+	// Send queues message for delivery and reports whether it was accepted.
+	Send(message []byte) bool
+
+	Rooms() map[*Room]bool
+	AddRoom(room *Room)
+	RemoveRoom(room *Room)
+
+	Disconnect()
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"go_chat_2/config"
 	"go_chat_2/repository"
 	"log"
 	"net/http"
+
+	"github.com/nats-io/nats.go"
 )
 
 var addr = flag.String("addr", ":8080", "http server address")
+var pubsubBackend = flag.String("pubsub-backend", "redis", "pub/sub backend for room messages and invites: redis or nats")
+var natsURL = flag.String("nats-url", nats.DefaultURL, "NATS server URL, used when -pubsub-backend=nats")
 
 func main() {
 	db := config.InitDB()
@@ -17,15 +22,37 @@ func main() {
 
 	flag.Parse()
 
-	wsServer := NewWebsocketServer(&repository.RoomRepository{Db: db}, &repository.UserRepository{Db: db})
+	pubsub, err := newPubSub(*pubsubBackend, *natsURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	wsServer := NewWebsocketServer(&repository.RoomRepository{Db: db}, &repository.UserRepository{Db: db}, &repository.MessageRepository{Db: db}, pubsub)
 	go wsServer.Run()
+	StartPollSessionReaper()
 
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		ServerWs(wsServer, w, r)
 	})
 
+	http.HandleFunc("/poll", func(w http.ResponseWriter, r *http.Request) {
+		ServerPoll(wsServer, w, r)
+	})
+
 	fs := http.FileServer(http.Dir("./public"))
 	http.Handle("/", fs)
 
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
+
+// newPubSub picks the PubSub backend rooms and invites are routed through.
+func newPubSub(backend, natsURL string) (PubSub, error) {
+	switch backend {
+	case "nats":
+		return NewNatsPubSub(natsURL)
+	case "redis":
+		return RedisPubSub{}, nil
+	default:
+		return nil, fmt.Errorf("unknown -pubsub-backend %q: want redis or nats", backend)
+	}
+}
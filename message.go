@@ -14,6 +14,49 @@ const (
 	UserLeftAction        = "user-left"
 	JoinRoomPrivateAction = "join-room-private"
 	RoomJoinedAction      = "room-joined"
+
+	// HistoryReplayAction carries a page of persisted messages pushed to a
+	// client that just joined a room, or returned in response to
+	// FetchHistoryAction.
+	HistoryReplayAction = "history-replay"
+
+	// FetchHistoryAction asks for an older page of a room's history, paging
+	// backwards from Before.
+	FetchHistoryAction = "fetch-history"
+
+	// AckAction tells the server the highest Seq a client has processed for
+	// Target, so a later reconnect can replay only what was missed.
+	AckAction = "ack"
+
+	// ErrorAction reports a problem with a specific request back to its
+	// sender; see the Err* codes below. The connection stays open.
+	ErrorAction = "error"
+)
+
+// knownActions is the set of Message.Action values dispatchMessage accepts.
+// Anything else is rejected with ErrUnknownAction.
+var knownActions = map[string]bool{
+	SendMessageAction:     true,
+	JoinRoomAction:        true,
+	LeaveRoomAction:       true,
+	JoinRoomPrivateAction: true,
+	FetchHistoryAction:    true,
+	AckAction:             true,
+}
+
+// maxMessageTextLength bounds Message.Message before it's dispatched, so a
+// single oversized frame can't be broadcast or persisted.
+const maxMessageTextLength = 4096
+
+// Error codes sent with ErrorAction, machine-readable so a client can branch
+// on them without parsing Message.Message.
+const (
+	ErrUnknownAction   = "unknown-action"
+	ErrRoomNotFound    = "room-not-found"
+	ErrTargetNotFound  = "target-not-found"
+	ErrUnauthorized    = "unauthorized"
+	ErrPayloadTooLarge = "payload-too-large"
+	ErrRateLimited     = "rate-limited"
 )
 
 type Message struct {
@@ -21,6 +64,27 @@ type Message struct {
 	Message string      `json:"message"`
 	Target  *Room       `json:"target"`
 	Sender  models.User `json:"sender"`
+
+	// History holds the encoded messages replayed by HistoryReplayAction,
+	// oldest first.
+	History []string `json:"history,omitempty"`
+
+	// Before pages a FetchHistoryAction request backwards: it's a UnixNano
+	// timestamp cursor, and only messages older than it are returned.
+	Before int64 `json:"before,omitempty"`
+
+	// Seq is the room-assigned, monotonic sequence number of this message.
+	// Room sets it before publishing; clients echo it back via AckAction.
+	Seq uint64 `json:"seq,omitempty"`
+
+	// ClientMsgID is an opaque id the sender attaches to a send-message so
+	// it can match it against the Seq the server assigns, e.g. to dedupe a
+	// retried send.
+	ClientMsgID string `json:"clientMsgId,omitempty"`
+
+	// ErrorCode is set alongside Action: ErrorAction to one of the Err*
+	// consts above; Message carries a human-readable description.
+	ErrorCode string `json:"errorCode,omitempty"`
 }
 
 func (message *Message) encode() []byte {
@@ -32,7 +96,10 @@ func (message *Message) encode() []byte {
 	return json
 }
 
-// UnmarshalJSON custom unmarshel to create a Client instance for Sender
+// UnmarshalJSON custom unmarshel to create a Client instance for Sender.
+// The decoded *Client also satisfies HandlerClient, so a Message read back
+// off pub/sub (e.g. an invite relayed through PubSubGeneralChannel) can
+// still be routed to a VirtualClient-backed target.
 func (message *Message) UnmarshalJSON(data []byte) error {
 	type Alias Message
 	msg := &struct {
@@ -0,0 +1,38 @@
+package main
+
+import "sync/atomic"
+
+// Counters for the per-client inbound message queue (see Client.messageChan).
+// queueDepth tracks the deepest queue observed so far, queueDrops
+// the number of frames dropped or disconnected for by the overflow policy.
+var (
+	queueDepth int64
+	queueDrops int64
+)
+
+func recordQueueDepth(depth int) {
+	for {
+		current := atomic.LoadInt64(&queueDepth)
+		if int64(depth) <= current {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&queueDepth, current, int64(depth)) {
+			return
+		}
+	}
+}
+
+func recordQueueDrop() {
+	atomic.AddInt64(&queueDrops, 1)
+}
+
+// QueueDepth returns the deepest per-client message queue observed so far.
+func QueueDepth() int64 {
+	return atomic.LoadInt64(&queueDepth)
+}
+
+// QueueDrops returns the number of frames dropped or disconnected for due to
+// a full message queue.
+func QueueDrops() int64 {
+	return atomic.LoadInt64(&queueDrops)
+}
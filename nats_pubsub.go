@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NatsPubSub implements PubSub on a NATS connection, selectable via config
+// as an alternative to Redis.
+type NatsPubSub struct {
+	conn *nats.Conn
+}
+
+// NewNatsPubSub connects to a NATS server at url.
+func NewNatsPubSub(url string) (*NatsPubSub, error) {
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	return &NatsPubSub{conn: conn}, nil
+}
+
+func (n *NatsPubSub) Publish(_ context.Context, channel string, payload []byte) error {
+	return n.conn.Publish(channel, payload)
+}
+
+func (n *NatsPubSub) Subscribe(_ context.Context, channel string) PubSubSubscription {
+	out := make(chan []byte, 64)
+
+	sub, err := n.conn.Subscribe(channel, func(msg *nats.Msg) {
+		out <- msg.Data
+	})
+	if err != nil {
+		close(out)
+		return &natsSubscription{out: out}
+	}
+
+	return &natsSubscription{sub: sub, out: out}
+}
+
+func (n *NatsPubSub) Close() error {
+	n.conn.Close()
+	return nil
+}
+
+type natsSubscription struct {
+	sub *nats.Subscription
+	out chan []byte
+}
+
+func (s *natsSubscription) Channel() <-chan []byte {
+	return s.out
+}
+
+func (s *natsSubscription) Unsubscribe() error {
+	if s.sub == nil {
+		return nil
+	}
+	return s.sub.Unsubscribe()
+}
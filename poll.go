@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// How long a GET /poll request blocks waiting for a message before
+	// returning an empty result.
+	pollWait = 25 * time.Second
+
+	// A poll session is dropped if it isn't polled again within this window.
+	pollSessionIdle = 2 * time.Minute
+
+	pollReapInterval = 30 * time.Second
+)
+
+// PollClient is the HandlerClient for the long-poll transport. It has no
+// socket; GET /poll drains send (mirroring Client.send) and POST /poll
+// submits a Message using the same JSON schema the websocket endpoint
+// accepts.
+type PollClient struct {
+	Token    string
+	wsServer *WsServer
+	send     chan []byte
+	rooms    map[*Room]bool
+	Name     string    `json:"name"`
+	ID       uuid.UUID `json:"id"`
+
+	mu       sync.Mutex
+	lastPoll time.Time
+}
+
+func newPollClient(wsServer *WsServer, name string) *PollClient {
+	return &PollClient{
+		Token:    uuid.New().String(),
+		ID:       uuid.New(),
+		Name:     name,
+		wsServer: wsServer,
+		send:     make(chan []byte, 256),
+		rooms:    make(map[*Room]bool),
+		lastPoll: time.Now(),
+	}
+}
+
+func (client *PollClient) GetId() string   { return client.ID.String() }
+func (client *PollClient) GetName() string { return client.Name }
+
+func (client *PollClient) Send(message []byte) bool {
+	select {
+	case client.send <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+func (client *PollClient) Rooms() map[*Room]bool { return client.rooms }
+func (client *PollClient) AddRoom(room *Room)     { client.rooms[room] = true }
+func (client *PollClient) RemoveRoom(room *Room)  { delete(client.rooms, room) }
+
+func (client *PollClient) touch() {
+	client.mu.Lock()
+	client.lastPoll = time.Now()
+	client.mu.Unlock()
+}
+
+func (client *PollClient) idleSince() time.Duration {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return time.Since(client.lastPoll)
+}
+
+// Disconnect leaves every room the session had joined and drops it from the
+// session store, the same cleanup a websocket Client does today.
+func (client *PollClient) Disconnect() {
+	for room := range client.rooms {
+		room.Unregister(client)
+	}
+	pollSessions.remove(client.Token)
+}
+
+// pollSessionStore keeps the long-poll sessions keyed by their opaque token.
+type pollSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*PollClient
+}
+
+var pollSessions = &pollSessionStore{sessions: make(map[string]*PollClient)}
+
+func (store *pollSessionStore) get(token string) *PollClient {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.sessions[token]
+}
+
+func (store *pollSessionStore) put(client *PollClient) {
+	store.mu.Lock()
+	store.sessions[client.Token] = client
+	store.mu.Unlock()
+}
+
+func (store *pollSessionStore) remove(token string) {
+	store.mu.Lock()
+	delete(store.sessions, token)
+	store.mu.Unlock()
+}
+
+// reapIdle disconnects and drops sessions that haven't been polled recently.
+// It's meant to run on a ticker for the lifetime of the process.
+func (store *pollSessionStore) reapIdle(maxIdle time.Duration) {
+	store.mu.Lock()
+	var stale []*PollClient
+	for _, client := range store.sessions {
+		if client.idleSince() > maxIdle {
+			stale = append(stale, client)
+		}
+	}
+	store.mu.Unlock()
+
+	for _, client := range stale {
+		client.Disconnect()
+	}
+}
+
+// StartPollSessionReaper launches the background loop that expires idle
+// long-poll sessions. Call it once, e.g. alongside wsServer.Run().
+func StartPollSessionReaper() {
+	go func() {
+		ticker := time.NewTicker(pollReapInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			pollSessions.reapIdle(pollSessionIdle)
+		}
+	}()
+}
+
+// ServerPoll handles the long-poll transport: a GET blocks for up to
+// pollWait waiting for new messages in the caller's session, a POST submits
+// one using the same Message JSON schema as the websocket endpoint.
+func ServerPoll(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		servePollGet(wsServer, w, r)
+	case http.MethodPost:
+		servePollPost(wsServer, w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func pollClientFor(wsServer *WsServer, r *http.Request) *PollClient {
+	token := r.URL.Query().Get("session")
+	if token != "" {
+		if client := pollSessions.get(token); client != nil {
+			return client
+		}
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		return nil
+	}
+
+	client := newPollClient(wsServer, name)
+	pollSessions.put(client)
+	return client
+}
+
+func servePollGet(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
+	client := pollClientFor(wsServer, r)
+	if client == nil {
+		http.Error(w, "missing 'session' or 'name' query param", http.StatusBadRequest)
+		return
+	}
+	client.touch()
+
+	var messages []json.RawMessage
+	select {
+	case message := <-client.send:
+		messages = append(messages, message)
+	case <-time.After(pollWait):
+	}
+
+	// Drain whatever else is already queued without blocking further.
+	for {
+		select {
+		case message := <-client.send:
+			messages = append(messages, message)
+			continue
+		default:
+		}
+		break
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Session  string            `json:"session"`
+		Messages []json.RawMessage `json:"messages"`
+	}{Session: client.Token, Messages: messages})
+}
+
+func servePollPost(wsServer *WsServer, w http.ResponseWriter, r *http.Request) {
+	client := pollClientFor(wsServer, r)
+	if client == nil {
+		http.Error(w, "missing 'session' or 'name' query param", http.StatusBadRequest)
+		return
+	}
+	client.touch()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+
+	// A long-poll session has no socket to close on a *protocolError; the
+	// malformed POST is simply rejected instead.
+	if err := dispatchMessage(wsServer, client, body); err != nil {
+		if _, ok := err.(*protocolError); ok {
+			http.Error(w, "malformed message", http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Session string `json:"session"`
+	}{Session: client.Token})
+}
@@ -0,0 +1,21 @@
+package main
+
+import "context"
+
+// PubSub is the cross-process message bus a Room publishes to and
+// subscribes on. WsServer picks one implementation at startup (Redis today,
+// optionally NATS) and hands it to every Room it creates, plus uses it
+// directly for PubSubGeneralChannel.
+type PubSub interface {
+	Publish(ctx context.Context, channel string, payload []byte) error
+	Subscribe(ctx context.Context, channel string) PubSubSubscription
+	Close() error
+}
+
+// PubSubSubscription is a single subscription returned by PubSub.Subscribe.
+// Payloads arrive on Channel(); call Unsubscribe once the owner is done with
+// it so the backend's subscription list doesn't grow without bound.
+type PubSubSubscription interface {
+	Channel() <-chan []byte
+	Unsubscribe() error
+}
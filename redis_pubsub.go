@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"go_chat_2/config"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisPubSub implements PubSub on top of the shared Redis client. It's the
+// backend this server has always used.
+type RedisPubSub struct{}
+
+func (RedisPubSub) Publish(ctx context.Context, channel string, payload []byte) error {
+	return config.Redis.Publish(ctx, channel, payload).Err()
+}
+
+func (RedisPubSub) Subscribe(ctx context.Context, channel string) PubSubSubscription {
+	pubsub := config.Redis.Subscribe(ctx, channel)
+
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		for msg := range pubsub.Channel() {
+			out <- []byte(msg.Payload)
+		}
+	}()
+
+	return &redisSubscription{pubsub: pubsub, out: out}
+}
+
+func (RedisPubSub) Close() error {
+	return config.Redis.Close()
+}
+
+type redisSubscription struct {
+	pubsub *redis.PubSub
+	out    chan []byte
+}
+
+func (s *redisSubscription) Channel() <-chan []byte {
+	return s.out
+}
+
+func (s *redisSubscription) Unsubscribe() error {
+	return s.pubsub.Close()
+}
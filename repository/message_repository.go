@@ -0,0 +1,152 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// StoredMessage is a persisted chat message, as returned to a client
+// replaying a room's history or paging further back into it.
+type StoredMessage struct {
+	RoomID    string    `json:"roomId"`
+	SenderID  string    `json:"senderId"`
+	Payload   string    `json:"payload"`
+	Seq       uint64    `json:"seq"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// MessageRepository persists the messages routed through a room so a client
+// that joins late can be caught up. It's the counterpart to RoomRepository.
+type MessageRepository struct {
+	Db *sql.DB
+}
+
+// Save stores a single message routed through room.publishRoomMessage.
+func (repo *MessageRepository) Save(roomID, senderID, payload string, seq uint64, createdAt time.Time) error {
+	_, err := repo.Db.Exec(
+		"INSERT INTO messages (room_id, sender_id, payload, seq, created_at) VALUES ($1, $2, $3, $4, $5)",
+		roomID, senderID, payload, seq, createdAt,
+	)
+	return err
+}
+
+// FetchSince returns, oldest first, every message for roomID with a Seq
+// greater than afterSeq - the at-least-once catch-up a reconnecting client
+// needs once its last ack is known.
+func (repo *MessageRepository) FetchSince(roomID string, afterSeq uint64) ([]StoredMessage, error) {
+	rows, err := repo.Db.Query(
+		"SELECT room_id, sender_id, payload, seq, created_at FROM messages WHERE room_id = $1 AND seq > $2 ORDER BY seq ASC",
+		roomID, afterSeq,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []StoredMessage
+	for rows.Next() {
+		var entry StoredMessage
+		if err := rows.Scan(&entry.RoomID, &entry.SenderID, &entry.Payload, &entry.Seq, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, entry)
+	}
+	return history, rows.Err()
+}
+
+// MaxSeq returns the highest Seq persisted for roomID, or 0 if it has no
+// messages yet. A room seeds its in-memory counter from this at creation so
+// a reaped-and-recreated room doesn't restart Seq from 1 while the store
+// still holds messages past it.
+func (repo *MessageRepository) MaxSeq(roomID string) (uint64, error) {
+	var seq sql.NullInt64
+	err := repo.Db.QueryRow(
+		"SELECT MAX(seq) FROM messages WHERE room_id = $1",
+		roomID,
+	).Scan(&seq)
+	if err != nil {
+		return 0, err
+	}
+	if !seq.Valid {
+		return 0, nil
+	}
+	return uint64(seq.Int64), nil
+}
+
+// SaveAck records userID's last-acked Seq in roomID, upserting so only the
+// highest acked Seq is kept; an ack lower than the stored one is ignored.
+func (repo *MessageRepository) SaveAck(roomID, userID string, seq uint64) error {
+	_, err := repo.Db.Exec(
+		`INSERT INTO message_acks (room_id, user_id, seq) VALUES ($1, $2, $3)
+		 ON CONFLICT (room_id, user_id) DO UPDATE SET seq = excluded.seq WHERE excluded.seq > message_acks.seq`,
+		roomID, userID, seq,
+	)
+	return err
+}
+
+// LastAck returns userID's last-acked Seq in roomID, or 0 if it never acked.
+func (repo *MessageRepository) LastAck(roomID, userID string) (uint64, error) {
+	var seq uint64
+	err := repo.Db.QueryRow(
+		"SELECT seq FROM message_acks WHERE room_id = $1 AND user_id = $2",
+		roomID, userID,
+	).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// FetchHistory returns up to limit messages for roomID, newest first. When
+// before is non-nil only messages older than it are returned, which is how
+// callers page further back into history.
+func (repo *MessageRepository) FetchHistory(roomID string, limit int, before *time.Time) ([]StoredMessage, error) {
+	query := "SELECT room_id, sender_id, payload, seq, created_at FROM messages WHERE room_id = $1"
+	args := []interface{}{roomID}
+	if before != nil {
+		query += " AND created_at < $2"
+		args = append(args, *before)
+	}
+	query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT %d", limit)
+
+	rows, err := repo.Db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []StoredMessage
+	for rows.Next() {
+		var entry StoredMessage
+		if err := rows.Scan(&entry.RoomID, &entry.SenderID, &entry.Payload, &entry.Seq, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, entry)
+	}
+	return history, rows.Err()
+}
+
+// FetchHistorySince returns up to limit messages for roomID newer than
+// after, oldest first - the counterpart to FetchHistory's before-cursor
+// paging, used to resume a `?since=` cursor that has no recorded ack.
+func (repo *MessageRepository) FetchHistorySince(roomID string, limit int, after time.Time) ([]StoredMessage, error) {
+	rows, err := repo.Db.Query(
+		fmt.Sprintf("SELECT room_id, sender_id, payload, seq, created_at FROM messages WHERE room_id = $1 AND created_at > $2 ORDER BY created_at ASC LIMIT %d", limit),
+		roomID, after,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []StoredMessage
+	for rows.Next() {
+		var entry StoredMessage
+		if err := rows.Scan(&entry.RoomID, &entry.SenderID, &entry.Payload, &entry.Seq, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, entry)
+	}
+	return history, rows.Err()
+}
@@ -2,38 +2,88 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
-	"go_chat_2/config"
+	"go_chat_2/repository"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 const welcomeMessage = "%s joined the room"
 
+// historyPageSize bounds how many persisted messages are replayed to a
+// client on join, or returned by a single fetch-history page.
+var historyPageSize = flag.Int("history-page-size", 50, "number of messages replayed on room join or fetch-history")
+
 var ctx = context.Background()
 
 type Room struct {
 	ID         uuid.UUID `json:"id"`
 	Name       string    `json:"name"`
 	Private    bool      `json:"private"`
-	clients    map[*Client]bool
-	register   chan *Client
-	unregister chan *Client
+	clients    map[HandlerClient]bool
+	register   chan HandlerClient
+	unregister chan HandlerClient
 	broadcast  chan *Message
+	messages   *repository.MessageRepository
+	pubsub     PubSub
+	onEmpty    func(*Room)
+	shutdown   chan struct{}
+
+	// seq is the room's monotonic message counter; publishRoomMessage
+	// assigns the next value before publishing.
+	seq uint64
+
+	// pendingReplay buffers live messages for a client whose history replay
+	// is still in flight, so broadcastToClientsInRoom can't deliver a live
+	// message ahead of older history still being fetched.
+	replayMu      sync.Mutex
+	pendingReplay map[HandlerClient]*[][]byte
+}
+
+// RoomDeps bundles the collaborators a Room needs beyond its name and
+// visibility. Messages may be nil (no history), OnEmpty may be nil (no
+// reaping callback when the room drains to zero clients).
+type RoomDeps struct {
+	PubSub   PubSub
+	Messages *repository.MessageRepository
+	OnEmpty  func(*Room)
 }
 
-// NewRoom creates a new room
-func NewRoom(name string, private bool) *Room {
-	return &Room{
-		ID:         uuid.New(),
-		Name:       name,
-		Private:    private,
-		clients:    make(map[*Client]bool),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		broadcast:  make(chan *Message),
+// NewRoom creates a new room.
+func NewRoom(name string, private bool, deps RoomDeps) *Room {
+	room := &Room{
+		ID:            uuid.New(),
+		Name:          name,
+		Private:       private,
+		clients:       make(map[HandlerClient]bool),
+		register:      make(chan HandlerClient),
+		unregister:    make(chan HandlerClient),
+		broadcast:     make(chan *Message),
+		messages:      deps.Messages,
+		pubsub:        deps.PubSub,
+		onEmpty:       deps.OnEmpty,
+		shutdown:      make(chan struct{}),
+		pendingReplay: make(map[HandlerClient]*[][]byte),
+	}
+
+	// Seed seq from what's already persisted, so a room reaped and later
+	// recreated under the same id doesn't hand out seqs the store already
+	// has - which would make FetchSince skip them and SaveAck's upsert
+	// reject the real (now lower-numbered) acks behind them.
+	if deps.Messages != nil {
+		if maxSeq, err := deps.Messages.MaxSeq(room.GetId()); err != nil {
+			log.Println(err)
+		} else {
+			room.seq = maxSeq
+		}
 	}
+
+	return room
 }
 
 func (room *Room) GetId() string {
@@ -48,7 +98,9 @@ func (room *Room) GetPrivate() bool {
 	return room.Private
 }
 
-// RunRoom runs our room, accepting various requests
+// RunRoom runs our room, accepting various requests. It exits once the room
+// has drained to zero clients, releasing its pub/sub subscription and
+// notifying onEmpty so the owner can forget about it.
 func (room *Room) RunRoom() {
 	go room.subscribeToRoomMessages()
 
@@ -58,31 +110,189 @@ func (room *Room) RunRoom() {
 			room.registerClientInRoom(client)
 		case client := <-room.unregister:
 			room.unregisterClientInRoom(client)
+			if len(room.clients) == 0 {
+				room.Shutdown()
+				return
+			}
 		case message := <-room.broadcast:
-			room.publishRoomMessage(message.encode())
+			room.publishRoomMessage(message)
 		}
 	}
 }
 
-func (room *Room) subscribeToRoomMessages() {
-	pubsub := config.Redis.Subscribe(ctx, room.GetName())
+// Register adds client to room and reports whether it took. It reports
+// false if room was reaped between the caller resolving it (e.g. via
+// findRoomByName) and this call - otherwise the caller would block forever
+// sending to a register channel nobody is receiving on anymore, and a
+// false report here tells it not to treat the join as having succeeded.
+func (room *Room) Register(client HandlerClient) bool {
+	select {
+	case room.register <- client:
+		return true
+	case <-room.shutdown:
+		return false
+	}
+}
 
-	ch := pubsub.Channel()
+// Unregister removes client from room, or does nothing if the room has
+// already been reaped. See Register for why this can't send unconditionally.
+func (room *Room) Unregister(client HandlerClient) {
+	select {
+	case room.unregister <- client:
+	case <-room.shutdown:
+	}
+}
 
-	for msg := range ch {
-		room.broadcastToClientsInRoom([]byte(msg.Payload))
+// Broadcast publishes message to room, or drops it if the room has already
+// been reaped. See Register for why this can't send unconditionally.
+func (room *Room) Broadcast(message *Message) {
+	select {
+	case room.broadcast <- message:
+	case <-room.shutdown:
 	}
 }
 
-func (room *Room) registerClientInRoom(client *Client) {
+// Shutdown releases the room's pub/sub subscription and, if set, calls
+// onEmpty so WsServer can drop the room from its registry.
+func (room *Room) Shutdown() {
+	close(room.shutdown)
+	if room.onEmpty != nil {
+		room.onEmpty(room)
+	}
+}
+
+func (room *Room) subscribeToRoomMessages() {
+	subscription := room.pubsub.Subscribe(ctx, room.GetName())
+
+	for {
+		select {
+		case payload, ok := <-subscription.Channel():
+			if !ok {
+				return
+			}
+			room.broadcastToClientsInRoom(payload)
+		case <-room.shutdown:
+			if err := subscription.Unsubscribe(); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+	}
+}
+
+func (room *Room) registerClientInRoom(client HandlerClient) {
+	// Add the client and, if there's history to replay, its pendingReplay
+	// placeholder under the same replayMu critical section that
+	// broadcastToClientsInRoom reads both under - otherwise that goroutine
+	// can range room.clients while this one is still writing it.
+	room.replayMu.Lock()
+	room.clients[client] = true
+	var buffered [][]byte
+	if room.messages != nil {
+		room.pendingReplay[client] = &buffered
+	}
+	room.replayMu.Unlock()
+
+	// The history fetch hits the DB and can be slow; run it off RunRoom's
+	// goroutine so it can't stall register/unregister/broadcast for the
+	// rest of the room while it's in flight. The pendingReplay buffer
+	// installed above keeps ordering correct in the meantime.
+	if room.messages != nil {
+		go room.replayHistoryTo(client)
+	}
+
 	// By sending the message first the new user won't see his own message.
 	if !room.Private {
 		room.notifyClientJoined(client)
 	}
-	room.clients[client] = true
 }
 
-func (room *Room) notifyClientJoined(client *Client) {
+// historySince is implemented by clients that were given a `?since=` cursor
+// at connect time (see ServerWs), limiting the initial history replay to
+// messages newer than it.
+type historySince interface {
+	HistorySince() *time.Time
+}
+
+// replayHistoryTo pushes persisted messages to client before it sees any
+// live traffic. registerClientInRoom runs it on its own goroutine, off
+// RunRoom's event loop, so a slow DB fetch can't stall register/unregister/
+// broadcast for the rest of the room; it must already have installed
+// client's pendingReplay buffer before spawning this. Messages published
+// while the fetch is in flight land in that buffer and are flushed
+// afterwards so ordering is preserved.
+//
+// A client with a recorded ack gets exactly what it missed, oldest first
+// (at-least-once catch-up after a brief disconnect); otherwise it gets the
+// usual timestamp-bounded history page.
+func (room *Room) replayHistoryTo(client HandlerClient) {
+	var payloads []string
+	if lastAck, err := room.messages.LastAck(room.GetId(), client.GetId()); err != nil {
+		log.Println(err)
+	} else if lastAck > 0 {
+		history, err := room.messages.FetchSince(room.GetId(), lastAck)
+		if err != nil {
+			log.Println(err)
+		}
+		payloads = make([]string, len(history))
+		for i, entry := range history {
+			payloads[i] = entry.Payload
+		}
+	} else {
+		var since *time.Time
+		if sourced, ok := client.(historySince); ok {
+			since = sourced.HistorySince()
+		}
+
+		if since != nil {
+			history, err := room.messages.FetchHistorySince(room.GetId(), *historyPageSize, *since)
+			if err != nil {
+				log.Println(err)
+			}
+			payloads = make([]string, len(history))
+			for i, entry := range history {
+				payloads[i] = entry.Payload
+			}
+		} else {
+			history, err := room.messages.FetchHistory(room.GetId(), *historyPageSize, nil)
+			if err != nil {
+				log.Println(err)
+			}
+			payloads = make([]string, len(history))
+			for i, entry := range history {
+				payloads[len(history)-1-i] = entry.Payload
+			}
+		}
+	}
+
+	if len(payloads) > 0 {
+		room.sendHistory(client, payloads)
+	}
+
+	// Flush the buffer and only then drop the pendingReplay entry, all under
+	// one replayMu critical section - otherwise broadcastToClientsInRoom
+	// could observe the entry gone and Send a live message directly while
+	// this loop is still mid-flush, reordering it ahead of older history.
+	room.replayMu.Lock()
+	for _, message := range *room.pendingReplay[client] {
+		client.Send(message)
+	}
+	delete(room.pendingReplay, client)
+	room.replayMu.Unlock()
+}
+
+// sendHistory packages a page of persisted messages as a single
+// HistoryReplayAction message. payloads must already be ordered oldest first.
+func (room *Room) sendHistory(client HandlerClient, payloads []string) {
+	replay := &Message{
+		Action:  HistoryReplayAction,
+		Target:  room,
+		History: payloads,
+	}
+	client.Send(replay.encode())
+}
+
+func (room *Room) notifyClientJoined(client HandlerClient) {
 	message := &Message{
 		Action:  SendMessageAction,
 		Target:  room,
@@ -90,24 +300,43 @@ func (room *Room) notifyClientJoined(client *Client) {
 	}
 
 	room.broadcastToClientsInRoom(message.encode())
-	room.publishRoomMessage(message.encode())
+	room.publishRoomMessage(message)
 }
 
-func (room *Room) unregisterClientInRoom(client *Client) {
-	if _, ok := room.clients[client]; ok {
-		delete(room.clients, client)
-	}
+func (room *Room) unregisterClientInRoom(client HandlerClient) {
+	room.replayMu.Lock()
+	delete(room.clients, client)
+	room.replayMu.Unlock()
 }
 
 func (room *Room) broadcastToClientsInRoom(message []byte) {
+	room.replayMu.Lock()
+	defer room.replayMu.Unlock()
+
 	for client := range room.clients {
-		client.send <- message
+		if buffered, replaying := room.pendingReplay[client]; replaying {
+			*buffered = append(*buffered, message)
+			continue
+		}
+		client.Send(message)
 	}
 }
 
-func (room *Room) publishRoomMessage(message []byte) {
-	err := config.Redis.Publish(ctx, room.GetName(), message).Err()
-	if err != nil {
+func (room *Room) publishRoomMessage(message *Message) {
+	message.Seq = atomic.AddUint64(&room.seq, 1)
+	encoded := message.encode()
+
+	if room.messages != nil {
+		senderID := ""
+		if message.Sender != nil {
+			senderID = message.Sender.GetId()
+		}
+		if err := room.messages.Save(room.GetId(), senderID, string(encoded), message.Seq, time.Now()); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if err := room.pubsub.Publish(ctx, room.GetName(), encoded); err != nil {
 		log.Println(err)
 	}
 }
@@ -0,0 +1,68 @@
+package main
+
+import "github.com/google/uuid"
+
+// VirtualSink receives the raw, encoded messages addressed to a
+// VirtualClient. Bots, bridges, and tests supply their own sink instead of a
+// websocket connection.
+type VirtualSink func(message []byte)
+
+// VirtualClient is a HandlerClient with no socket behind it. It can join
+// rooms and be addressed as a Message sender exactly like a websocket
+// client, but delivery goes through an arbitrary sink instead of a
+// connection - e.g. forwarding to an SMS gateway or IRC bridge, or just
+// collecting messages in a test.
+type VirtualClient struct {
+	ID    uuid.UUID `json:"id"`
+	Name  string    `json:"name"`
+	rooms map[*Room]bool
+	sink  VirtualSink
+}
+
+// NewVirtualClient creates a client addressable by rooms and other clients,
+// whose outgoing messages are handed to sink instead of written to a socket.
+func NewVirtualClient(name string, sink VirtualSink) *VirtualClient {
+	return &VirtualClient{
+		ID:    uuid.New(),
+		Name:  name,
+		rooms: make(map[*Room]bool),
+		sink:  sink,
+	}
+}
+
+func (client *VirtualClient) GetId() string {
+	return client.ID.String()
+}
+
+func (client *VirtualClient) GetName() string {
+	return client.Name
+}
+
+// Send hands message to the client's sink. It reports false if there is no
+// sink to deliver to.
+func (client *VirtualClient) Send(message []byte) bool {
+	if client.sink == nil {
+		return false
+	}
+	client.sink(message)
+	return true
+}
+
+func (client *VirtualClient) Rooms() map[*Room]bool {
+	return client.rooms
+}
+
+func (client *VirtualClient) AddRoom(room *Room) {
+	client.rooms[room] = true
+}
+
+func (client *VirtualClient) RemoveRoom(room *Room) {
+	delete(client.rooms, room)
+}
+
+// Disconnect leaves every room the client had joined.
+func (client *VirtualClient) Disconnect() {
+	for room := range client.rooms {
+		room.Unregister(client)
+	}
+}